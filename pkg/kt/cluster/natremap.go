@@ -0,0 +1,43 @@
+package cluster
+
+import (
+	"bytes"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// ProgramCidrRemap installs an iptables NETMAP rule inside the shadow pod so
+// traffic the client sends to "from" lands on "to" instead, the other half
+// of --cidrRemap: the client-side CIDR swap alone only stops the clash
+// check from firing, it doesn't make the remapped range actually routable.
+func ProgramCidrRemap(restConfig *rest.Config, clientset kubernetes.Interface, namespace, podName, from, to string) error {
+	cmd := []string{"iptables", "-t", "nat", "-A", "OUTPUT", "-d", from, "-j", "NETMAP", "--to", to}
+
+	req := clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(namespace).
+		Name(podName).
+		SubResource("exec")
+	req.VersionedParams(&corev1.PodExecOptions{
+		Command: cmd,
+		Stdout:  true,
+		Stderr:  true,
+	}, scheme.ParameterCodec)
+
+	executor, err := remotecommand.NewSPDYExecutor(restConfig, "POST", req.URL())
+	if err != nil {
+		return err
+	}
+
+	var stdout, stderr bytes.Buffer
+	if err := executor.Stream(remotecommand.StreamOptions{Stdout: &stdout, Stderr: &stderr}); err != nil {
+		return fmt.Errorf("failed to program CIDR remap %s -> %s in shadow pod %s: %s: %s",
+			from, to, podName, err.Error(), stderr.String())
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package cluster
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+)
+
+// ShadowHandle identifies a provisioned shadow pod together with the
+// transport chosen to reach it, so callers don't need to branch on
+// direct-vs-port-forward connectivity themselves.
+type ShadowHandle struct {
+	PodName   string
+	Namespace string
+	Transport ShadowTransport
+}
+
+// ShadowTransport gives the SSH/tunnel client a way to reach the shadow pod
+// without assuming its pod IP is directly dialable. DirectTransport dials
+// endPointIP:sshPort as before; PortForwardTransport tunnels through the
+// Kubernetes API server for clusters where only the API server, not pod
+// IPs, is reachable from the client.
+type ShadowTransport interface {
+	// Dial returns a connection to the shadow pod's SSH port.
+	Dial() (net.Conn, error)
+	// Close releases any resources (forwarders, listeners) held by the transport.
+	Close() error
+}
+
+// NewShadowTransport selects a ShadowTransport based on mode ("direct",
+// "portforward" or "auto"). In "auto" mode it probes direct reachability
+// with a short TCP dial before falling back to port-forwarding.
+func NewShadowTransport(mode, namespace, podName, endPointIP string, sshPort int, restConfig *rest.Config, clientset kubernetes.Interface) (ShadowTransport, error) {
+	switch mode {
+	case "direct":
+		return NewDirectTransport(endPointIP, sshPort), nil
+	case "portforward":
+		return NewPortForwardTransport(namespace, podName, sshPort, restConfig, clientset)
+	case "auto", "":
+		if probeDirectReachable(endPointIP, sshPort, 2*time.Second) {
+			return NewDirectTransport(endPointIP, sshPort), nil
+		}
+		log.Info().Msgf("Shadow pod %s:%d not directly reachable, falling back to port-forward", endPointIP, sshPort)
+		return NewPortForwardTransport(namespace, podName, sshPort, restConfig, clientset)
+	default:
+		return nil, fmt.Errorf("unknown shadow transport mode: %s", mode)
+	}
+}
+
+func probeDirectReachable(endPointIP string, sshPort int, timeout time.Duration) bool {
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", endPointIP, sshPort), timeout)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+// DirectTransport dials the shadow pod's IP directly, as kt-connect has
+// always done on VPN/SOCKS tunnels where the pod network is routable.
+type DirectTransport struct {
+	addr string
+}
+
+// NewDirectTransport returns a ShadowTransport that dials endPointIP:sshPort directly.
+func NewDirectTransport(endPointIP string, sshPort int) *DirectTransport {
+	return &DirectTransport{addr: fmt.Sprintf("%s:%d", endPointIP, sshPort)}
+}
+
+func (t *DirectTransport) Dial() (net.Conn, error) {
+	return net.Dial("tcp", t.addr)
+}
+
+func (t *DirectTransport) Close() error {
+	return nil
+}
+
+// PortForwardTransport multiplexes connections to the shadow pod's SSH port
+// through the Kubernetes API server, the same mechanism `kubectl port-forward`
+// uses, for clusters where pod IPs aren't reachable from the client
+// (restrictive security groups, GKE Autopilot, private AKS endpoints, ...).
+//
+// It does not open its own listener: client-go's portforward package binds
+// the local side itself (127.0.0.1:0, ports spec "0:sshPort"), so Dial just
+// needs to learn which local port that ended up being via fw.GetPorts().
+type PortForwardTransport struct {
+	namespace  string
+	podName    string
+	sshPort    int
+	restConfig *rest.Config
+	clientset  kubernetes.Interface
+
+	localPort int32 // atomic; 0 until the first successful forward is ready
+	stopCh    chan struct{}
+	readyOnce sync.Once
+	readyCh   chan struct{}
+}
+
+// NewPortForwardTransport opens a long-lived forwarder keyed on
+// (namespace, podName, sshPort). It blocks until the first forward is ready
+// (or errors out) so Dial never races an unset local port, and
+// auto-reconnects the underlying SPDY stream with exponential backoff on
+// error.
+func NewPortForwardTransport(namespace, podName string, sshPort int, restConfig *rest.Config, clientset kubernetes.Interface) (*PortForwardTransport, error) {
+	t := &PortForwardTransport{
+		namespace:  namespace,
+		podName:    podName,
+		sshPort:    sshPort,
+		restConfig: restConfig,
+		clientset:  clientset,
+		stopCh:     make(chan struct{}),
+		readyCh:    make(chan struct{}),
+	}
+	go t.serveWithReconnect()
+
+	select {
+	case <-t.readyCh:
+		return t, nil
+	case <-time.After(30 * time.Second):
+		t.Close()
+		return nil, fmt.Errorf("timed out waiting for port-forward to %s/%s to become ready", namespace, podName)
+	}
+}
+
+func (t *PortForwardTransport) Dial() (net.Conn, error) {
+	port := atomic.LoadInt32(&t.localPort)
+	if port == 0 {
+		return nil, fmt.Errorf("port-forward to %s/%s is not ready yet", t.namespace, t.podName)
+	}
+	return net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+}
+
+func (t *PortForwardTransport) Close() error {
+	close(t.stopCh)
+	return nil
+}
+
+func (t *PortForwardTransport) serveWithReconnect() {
+	backoff := time.Second
+	const maxBackoff = 30 * time.Second
+	for {
+		select {
+		case <-t.stopCh:
+			return
+		default:
+		}
+
+		if err := t.runForwarder(); err != nil {
+			log.Error().Msgf("Port-forward to %s/%s:%d failed, retrying in %s: %s",
+				t.namespace, t.podName, t.sshPort, backoff, err.Error())
+			select {
+			case <-time.After(backoff):
+			case <-t.stopCh:
+				return
+			}
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+		backoff = time.Second
+	}
+}
+
+func (t *PortForwardTransport) runForwarder() error {
+	roundTripper, upgrader, err := spdy.RoundTripperFor(t.restConfig)
+	if err != nil {
+		return err
+	}
+
+	req := t.clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(t.namespace).
+		Name(t.podName).
+		SubResource("portforward")
+
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: roundTripper}, "POST", req.URL())
+	stopCh := make(chan struct{})
+	readyCh := make(chan struct{})
+
+	ports := []string{fmt.Sprintf("0:%d", t.sshPort)}
+	fw, err := portforward.NewOnAddresses(dialer, []string{"127.0.0.1"}, ports, stopCh, readyCh, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- fw.ForwardPorts() }()
+
+	select {
+	case <-readyCh:
+		if err := t.publishForwardedPort(fw); err != nil {
+			close(stopCh)
+			return err
+		}
+	case err := <-errCh:
+		return err
+	}
+
+	select {
+	case <-t.stopCh:
+		close(stopCh)
+		return nil
+	case err := <-errCh:
+		atomic.StoreInt32(&t.localPort, 0)
+		return err
+	}
+}
+
+// portLister is the slice of *portforward.PortForwarder's API that
+// publishForwardedPort needs, so the real-port-wiring logic can be unit
+// tested without standing up a fake API server.
+type portLister interface {
+	GetPorts() ([]portforward.ForwardedPort, error)
+}
+
+// publishForwardedPort reads back the local port client-go's portforward
+// package bound (ports spec "0:sshPort" means the OS picks it) and publishes
+// it so Dial knows where to connect.
+func (t *PortForwardTransport) publishForwardedPort(fw portLister) error {
+	forwarded, err := fw.GetPorts()
+	if err != nil {
+		return err
+	}
+	if len(forwarded) == 0 {
+		return fmt.Errorf("port-forward to %s/%s reported no forwarded ports", t.namespace, t.podName)
+	}
+	atomic.StoreInt32(&t.localPort, int32(forwarded[0].Local))
+	t.readyOnce.Do(func() { close(t.readyCh) })
+	return nil
+}
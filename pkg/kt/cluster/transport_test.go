@@ -0,0 +1,111 @@
+package cluster
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/tools/portforward"
+)
+
+type fakePortLister struct {
+	ports []portforward.ForwardedPort
+	err   error
+}
+
+func (f *fakePortLister) GetPorts() ([]portforward.ForwardedPort, error) {
+	return f.ports, f.err
+}
+
+// TestPublishForwardedPortWiresRealPort proves the actual fix: the local
+// port Dial connects to comes from what client-go's forwarder reports via
+// GetPorts(), not a pre-allocated listener nothing ever fed.
+func TestPublishForwardedPortWiresRealPort(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to open test listener: %s", err.Error())
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	realPort := listener.Addr().(*net.TCPAddr).Port
+
+	transport := &PortForwardTransport{
+		namespace: "default",
+		podName:   "kt-connect-daemon-test",
+		readyCh:   make(chan struct{}),
+	}
+
+	if err := transport.publishForwardedPort(&fakePortLister{
+		ports: []portforward.ForwardedPort{{Local: uint16(realPort)}},
+	}); err != nil {
+		t.Fatalf("publishForwardedPort failed: %s", err.Error())
+	}
+
+	select {
+	case <-transport.readyCh:
+	default:
+		t.Fatal("expected publishForwardedPort to close readyCh")
+	}
+	if got := atomic.LoadInt32(&transport.localPort); got != int32(realPort) {
+		t.Fatalf("expected localPort to be set to %d, got %d", realPort, got)
+	}
+
+	conn, err := transport.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed to reach the published port: %s", err.Error())
+	}
+	conn.Close()
+}
+
+func TestPublishForwardedPortRejectsEmptyPorts(t *testing.T) {
+	transport := &PortForwardTransport{
+		namespace: "default",
+		podName:   "kt-connect-daemon-test",
+		readyCh:   make(chan struct{}),
+	}
+	if err := transport.publishForwardedPort(&fakePortLister{}); err == nil {
+		t.Fatal("expected publishForwardedPort to reject a report with no forwarded ports")
+	}
+}
+
+func TestProbeDirectReachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to open test listener: %s", err.Error())
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	if !probeDirectReachable("127.0.0.1", addr.Port, time.Second) {
+		t.Fatal("expected listening port to be reachable")
+	}
+
+	closedListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to open throwaway listener: %s", err.Error())
+	}
+	closedPort := closedListener.Addr().(*net.TCPAddr).Port
+	closedListener.Close()
+
+	if probeDirectReachable("127.0.0.1", closedPort, time.Second) {
+		t.Fatal("expected closed port to be unreachable")
+	}
+}
@@ -1,20 +1,19 @@
 package command
 
 import (
+	"context"
 	"fmt"
 	"github.com/alibaba/kt-connect/pkg/kt/registry"
-	"github.com/cilium/ipam/service/allocator"
-	"net"
 	"os"
 	"strings"
 
 	"github.com/alibaba/kt-connect/pkg/common"
 	"github.com/alibaba/kt-connect/pkg/kt/cluster"
+	"github.com/alibaba/kt-connect/pkg/kt/dns"
 
 	"github.com/alibaba/kt-connect/pkg/kt"
 	"github.com/alibaba/kt-connect/pkg/kt/options"
 	"github.com/alibaba/kt-connect/pkg/kt/util"
-	"github.com/cilium/ipam/service/ipallocator"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	urfave "github.com/urfave/cli"
@@ -43,7 +42,27 @@ func newConnectCommand(cli kt.CliInterface, options *options.DaemonOptions, acti
 
 func CompleteOptions(options *options.DaemonOptions) error {
 	if options.ConnectOptions.Method == common.ConnectMethodTun {
-		srcIP, destIP, err := allocateTunIP(options.ConnectOptions.TunCidr)
+		if options.ConnectOptions.MultiCluster {
+			connects, err := registry.NewConnectsStore()
+			if err != nil {
+				return err
+			}
+			cidr, err := connects.ReserveTunCidr(options.ConnectOptions.TunCidrSuperRange, options.KubeContext)
+			if err != nil {
+				return err
+			}
+			options.ConnectOptions.TunCidr = cidr
+		}
+
+		if options.ConnectOptions.Allocator == nil {
+			allocator, err := registry.NewPersistentAllocator(options.ConnectOptions.TunSourceIP, options.ConnectOptions.TunDestIP)
+			if err != nil {
+				return err
+			}
+			options.ConnectOptions.Allocator = allocator
+		}
+
+		srcIP, destIP, err := options.ConnectOptions.Allocator.Acquire(context.Background(), options.ConnectOptions.TunCidr)
 		if err != nil {
 			return err
 		}
@@ -56,9 +75,12 @@ func CompleteOptions(options *options.DaemonOptions) error {
 
 // Connect connect vpn to kubernetes cluster
 func (action *Action) Connect(cli kt.CliInterface, options *options.DaemonOptions) (err error) {
-	if util.IsDaemonRunning(options.RuntimeOptions.PidFile) {
-		return fmt.Errorf("another connect process already running with %s, exiting", options.RuntimeOptions.PidFile)
+	connects, err := registry.NewConnectsStore()
+	if err != nil {
+		return err
 	}
+	options.RuntimeOptions.Connects = connects
+
 	ch := SetUpCloseHandler(cli, options, "connect")
 	if err = connectToCluster(cli, options); err != nil {
 		return
@@ -66,6 +88,7 @@ func (action *Action) Connect(cli kt.CliInterface, options *options.DaemonOption
 	// watch background process, clean the workspace and exit if background process occur exception
 	go func() {
 		<-util.Interrupt()
+		releaseConnectState(options)
 		CleanupWorkspace(cli, options)
 		os.Exit(0)
 	}()
@@ -82,13 +105,26 @@ func connectToCluster(cli kt.CliInterface, options *options.DaemonOptions) (err
 	}
 	log.Info().Msgf("Connect start at %d", pid)
 
+	// the PID-file guard used to be global, so a second `connect` against a
+	// different cluster context would fail with "already running" even
+	// though the two tunnels don't conflict; registering per-context here
+	// lets them coexist.
+	if err = options.RuntimeOptions.Connects.Register(registry.ConnectRecord{
+		Context:   options.KubeContext,
+		Namespace: options.Namespace,
+		Pid:       pid,
+		TunCidr:   options.ConnectOptions.TunCidr,
+	}); err != nil {
+		return err
+	}
+
 	kubernetes, err := cli.Kubernetes()
 	if err != nil {
 		return
 	}
 
-	if util.IsWindows() || len(options.ConnectOptions.Dump2HostsNamespaces) > 0 {
-		setupDump2Host(options, kubernetes)
+	if err = setupDump2Host(options, kubernetes); err != nil {
+		return
 	}
 	if options.ConnectOptions.Method == common.ConnectMethodSocks {
 		err = registry.SetGlobalProxy(options.ConnectOptions.SocksPort, &options.RuntimeOptions.ProxyConfig)
@@ -101,7 +137,7 @@ func connectToCluster(cli kt.CliInterface, options *options.DaemonOptions) (err
 		}
 	}
 
-	endPointIP, podName, credential, err := getOrCreateShadow(options, err, kubernetes)
+	shadow, credential, err := getOrCreateShadow(options, err, kubernetes)
 	if err != nil {
 		return
 	}
@@ -110,11 +146,89 @@ func connectToCluster(cli kt.CliInterface, options *options.DaemonOptions) (err
 	if err != nil {
 		return
 	}
+	cidrs, err = checkCidrClash(options, kubernetes, shadow.PodName, cidrs)
+	if err != nil {
+		return
+	}
+	if err = options.RuntimeOptions.Connects.Register(registry.ConnectRecord{
+		Context:               options.KubeContext,
+		Namespace:             options.Namespace,
+		Pid:                   pid,
+		TunCidr:               options.ConnectOptions.TunCidr,
+		AllocatedClusterCIDRs: cidrs,
+		ShadowPod:             shadow.PodName,
+	}); err != nil {
+		return
+	}
 
-	return cli.Shadow().Outbound(podName, endPointIP, credential, cidrs, cli.Exec())
+	return cli.Shadow().Outbound(shadow.PodName, shadow.Transport, credential, cidrs, cli.Exec())
+}
+
+// releaseConnectState undoes what connectToCluster/CompleteOptions acquired:
+// it removes only this context's entry from the connects registry, leaving
+// every other active connect untouched; releases this CIDR's tun IP lease so
+// the allocator's "release" half of the contract is actually exercised
+// instead of staying dead code; and, if setupLocalDNS patched the system
+// resolver, stops the resolver goroutine and restores it so host DNS doesn't
+// stay pointed at a server that's about to disappear.
+func releaseConnectState(options *options.DaemonOptions) {
+	if options.RuntimeOptions.Connects != nil {
+		if err := options.RuntimeOptions.Connects.Unregister(options.KubeContext); err != nil {
+			log.Error().Msgf("Failed to unregister connect for context %s: %s", options.KubeContext, err.Error())
+		}
+	}
+	if options.ConnectOptions.Allocator != nil {
+		if err := options.ConnectOptions.Allocator.Release(context.Background(), options.ConnectOptions.TunCidr); err != nil {
+			log.Error().Msgf("Failed to release tun IP lease for %s: %s", options.ConnectOptions.TunCidr, err.Error())
+		}
+	}
+	if options.RuntimeOptions.DnsResolver != nil {
+		options.RuntimeOptions.DnsResolver.Stop()
+	}
+	if options.RuntimeOptions.RestoreResolver != nil {
+		if err := options.RuntimeOptions.RestoreResolver(); err != nil {
+			log.Error().Msgf("Failed to restore system resolver: %s", err.Error())
+		}
+	}
 }
 
-func getOrCreateShadow(options *options.DaemonOptions, err error, kubernetes cluster.KubernetesInterface) (string, string, *util.SSHCredential, error) {
+// checkCidrClash rejects cidrs that another active connect already routes,
+// unless the user remapped the clashing range with --cidrRemap, in which
+// case it programs the remap as a NAT rule in the shadow pod and returns the
+// remapped range so the caller actually routes/registers *that* instead of
+// silently keeping the clashing original.
+func checkCidrClash(options *options.DaemonOptions, kubernetes cluster.KubernetesInterface, podName string, cidrs []string) ([]string, error) {
+	routed, err := options.RuntimeOptions.Connects.RoutedCIDRs(options.KubeContext)
+	if err != nil {
+		return nil, err
+	}
+
+	remapped := make([]string, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if remap, ok := options.ConnectOptions.CidrRemap[cidr]; ok {
+			log.Info().Msgf("Remapping clashing CIDR %s -> %s", cidr, remap)
+			if err := cluster.ProgramCidrRemap(kubernetes.RestConfig(), kubernetes.Clientset(), options.Namespace, podName, remap, cidr); err != nil {
+				return nil, err
+			}
+			remapped = append(remapped, remap)
+			continue
+		}
+		for _, other := range routed {
+			if cidr == other {
+				return nil, fmt.Errorf("cluster CIDR %s is already routed by another active connect, "+
+					"use --cidrRemap=%s=<new-range> to remap it", cidr, cidr)
+			}
+		}
+		remapped = append(remapped, cidr)
+	}
+	return remapped, nil
+}
+
+// getOrCreateShadow provisions the shadow pod and wraps it in a
+// cluster.ShadowHandle so the rest of the connect flow dials the pod's SSH
+// port through whichever cluster.ShadowTransport was selected, rather than
+// assuming the caller can always reach endPointIP directly.
+func getOrCreateShadow(options *options.DaemonOptions, err error, kubernetes cluster.KubernetesInterface) (*cluster.ShadowHandle, *util.SSHCredential, error) {
 	workload := fmt.Sprintf("kt-connect-daemon-%s", strings.ToLower(util.RandomString(5)))
 	if options.ConnectOptions.ShareShadow {
 		workload = fmt.Sprintf("kt-connect-daemon-connect-shared")
@@ -123,23 +237,92 @@ func getOrCreateShadow(options *options.DaemonOptions, err error, kubernetes clu
 	annotations := make(map[string]string)
 	endPointIP, podName, sshcm, credential, err := kubernetes.GetOrCreateShadow(workload, options, labels(workload, options), annotations, envs(options))
 	if err != nil {
-		return "", "", nil, err
+		return nil, nil, err
+	}
+
+	transport, err := cluster.NewShadowTransport(
+		options.ConnectOptions.ShadowTransport,
+		options.Namespace,
+		podName,
+		endPointIP,
+		util.SSHPort,
+		kubernetes.RestConfig(),
+		kubernetes.Clientset(),
+	)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	// record shadow name will clean up terminal
 	options.RuntimeOptions.Shadow = workload
 	options.RuntimeOptions.SSHCM = sshcm
 
-	return endPointIP, podName, credential, nil
+	return &cluster.ShadowHandle{PodName: podName, Namespace: options.Namespace, Transport: transport}, credential, nil
+}
+
+// setupDump2Host dispatches to the configured DNS mode: a live resolver for
+// --dnsMode=localDNS, or the legacy one-shot /etc/hosts writer everywhere
+// else (and always on Windows, where we cannot reliably bind :53).
+func setupDump2Host(options *options.DaemonOptions, kubernetes cluster.KubernetesInterface) error {
+	if options.ConnectOptions.DnsMode == common.DnsModeLocalDNS && !util.IsWindows() {
+		return setupLocalDNS(options, kubernetes)
+	}
+	return dump2Hosts(options, kubernetes)
 }
 
-func setupDump2Host(options *options.DaemonOptions, kubernetes cluster.KubernetesInterface) {
+// setupLocalDNS starts an in-process resolver that answers from a live
+// Services/Endpoints cache instead of a point-in-time snapshot.
+func setupLocalDNS(options *options.DaemonOptions, kubernetes cluster.KubernetesInterface) error {
+	listenAddr := util.LoopbackDNSAddr()
+	resolver := dns.NewResolver(kubernetes.Clientset(), dns.Options{
+		Namespaces:       namespacesToWatch(options),
+		CurrentNamespace: options.Namespace,
+		ListenAddr:       listenAddr,
+		Upstream:         util.SystemUpstreamResolver(),
+		PodForwarder:     kubernetes.PodDNSForwarder(options.Namespace),
+	})
+
+	restore, err := dns.PatchSystemResolver(listenAddr)
+	if err != nil {
+		log.Error().Msgf("Failed to patch system resolver, falling back to /etc/hosts: %s", err.Error())
+		return dump2Hosts(options, kubernetes)
+	}
+	options.RuntimeOptions.RestoreResolver = restore
+
+	go func() {
+		if err := resolver.Start(kubernetes.Clientset()); err != nil {
+			log.Error().Msgf("Local DNS resolver stopped: %s", err.Error())
+		}
+	}()
+	options.RuntimeOptions.DnsResolver = resolver
+	return nil
+}
+
+// namespacesToWatch returns the namespaces the resolver needs an informer
+// for: the current namespace (so "<svc>" short names resolve, the headline
+// reason --dnsMode=localDNS exists) plus whatever extra namespaces the user
+// asked for with --dnsNamespaces.
+func namespacesToWatch(options *options.DaemonOptions) []string {
+	namespaces := []string{options.Namespace}
+	for _, ns := range options.ConnectOptions.DnsNamespaces {
+		if ns == options.Namespace {
+			continue
+		}
+		namespaces = append(namespaces, ns)
+	}
+	return namespaces
+}
+
+// dump2Hosts is the legacy one-shot /etc/hosts writer, kept as a fallback for
+// Windows (and as a safety net if patching the system resolver fails; a
+// later failure of the local resolver to bind is only logged).
+func dump2Hosts(options *options.DaemonOptions, kubernetes cluster.KubernetesInterface) error {
 	hosts := kubernetes.ServiceHosts(options.Namespace)
 	for k, v := range hosts {
 		log.Info().Msgf("Service found: %s %s", k, v)
 	}
-	if len(options.ConnectOptions.Dump2HostsNamespaces) > 0 {
-		for _, namespace := range options.ConnectOptions.Dump2HostsNamespaces {
+	if len(options.ConnectOptions.DnsNamespaces) > 0 {
+		for _, namespace := range options.ConnectOptions.DnsNamespaces {
 			if namespace == options.Namespace {
 				continue
 			}
@@ -156,6 +339,7 @@ func setupDump2Host(options *options.DaemonOptions, kubernetes cluster.Kubernete
 	}
 	util.DumpHosts(hosts)
 	options.RuntimeOptions.Dump2Host = true
+	return nil
 }
 
 func envs(options *options.DaemonOptions) map[string]string {
@@ -184,24 +368,3 @@ func labels(workload string, options *options.DaemonOptions) map[string]string {
 	return labels
 }
 
-func allocateTunIP(cidr string) (srcIP, destIP string, err error) {
-	_, ipnet, err := net.ParseCIDR(cidr)
-	if err != nil {
-		return "", "", err
-	}
-	rge, err := ipallocator.NewAllocatorCIDRRange(ipnet, func(max int, rangeSpec string) (allocator.Interface, error) {
-		return allocator.NewContiguousAllocationMap(max, rangeSpec), nil
-	})
-	if err != nil {
-		return "", "", err
-	}
-	ip1, err := rge.AllocateNext()
-	if err != nil {
-		return "", "", err
-	}
-	ip2, err := rge.AllocateNext()
-	if err != nil {
-		return "", "", err
-	}
-	return ip1.String(), ip2.String(), nil
-}
@@ -0,0 +1,78 @@
+package dns
+
+import (
+	"fmt"
+
+	"github.com/alibaba/kt-connect/pkg/kt/util"
+	"github.com/rs/zerolog/log"
+)
+
+// PatchSystemResolver points the OS resolver at the local Resolver and
+// returns a restore func that undoes the change.
+//
+// Linux rewrites /etc/resolv.conf, macOS adds a scutil(8) resolver entry
+// scoped to cluster.local, and Windows programs an NRPT rule so only
+// cluster.local queries are redirected — the system-wide resolver order is
+// left untouched everywhere else.
+func PatchSystemResolver(listenAddr string) (restore func() error, err error) {
+	if util.IsWindows() {
+		return patchWindowsNRPT(listenAddr)
+	}
+	if util.IsMacOS() {
+		return patchMacScutil(listenAddr)
+	}
+	return patchResolvConf(listenAddr)
+}
+
+func patchResolvConf(listenAddr string) (func() error, error) {
+	const path = "/etc/resolv.conf"
+	original, err := util.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	content := fmt.Sprintf("nameserver %s\n%s", host(listenAddr), original)
+	if err := util.WriteFile(path, content); err != nil {
+		return nil, err
+	}
+	return func() error {
+		log.Info().Msg("Restoring /etc/resolv.conf")
+		return util.WriteFile(path, original)
+	}, nil
+}
+
+func patchMacScutil(listenAddr string) (func() error, error) {
+	script := fmt.Sprintf(`d init
+d add nameserver %s
+d add domain_name cluster.local
+d add search_order 1
+set State:/Network/Service/ktctl-localdns/DNS
+`, host(listenAddr))
+	if err := util.RunCommandWithStdin("scutil", script); err != nil {
+		return nil, err
+	}
+	return func() error {
+		log.Info().Msg("Removing scutil ktctl-localdns resolver")
+		return util.RunCommandWithStdin("scutil", "remove State:/Network/Service/ktctl-localdns/DNS\n")
+	}, nil
+}
+
+func patchWindowsNRPT(listenAddr string) (func() error, error) {
+	if err := util.RunCommand("powershell", "-Command",
+		fmt.Sprintf("Add-DnsClientNrptRule -Namespace '.cluster.local' -NameServers '%s'", host(listenAddr))); err != nil {
+		return nil, err
+	}
+	return func() error {
+		log.Info().Msg("Removing NRPT rule for cluster.local")
+		return util.RunCommand("powershell", "-Command",
+			"Get-DnsClientNrptRule | Where-Object Namespace -eq '.cluster.local' | Remove-DnsClientNrptRule -Force")
+	}, nil
+}
+
+func host(addr string) string {
+	for i := len(addr) - 1; i >= 0; i-- {
+		if addr[i] == ':' {
+			return addr[:i]
+		}
+	}
+	return addr
+}
@@ -0,0 +1,292 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const clusterDomainSuffix = ".svc.cluster.local."
+
+// hostEntry is what reindex resolves a single fqdn to: its addresses plus
+// the ports services.ports/endpoints.subsets expose, the latter needed to
+// answer SRV queries.
+type hostEntry struct {
+	ips   []net.IP
+	ports []int32
+}
+
+// Options configure a local Resolver.
+type Options struct {
+	// Namespaces is the set of namespaces the resolver keeps a live informer for.
+	Namespaces []string
+	// CurrentNamespace is the namespace a bare "<svc>" query is resolved in.
+	CurrentNamespace string
+	// ListenAddr is the local address the resolver binds to, e.g. "127.0.0.1:53".
+	ListenAddr string
+	// Upstream is used for anything that isn't a cluster.local name.
+	Upstream string
+	// PodForwarder, when set, is used to forward in-cluster pod DNS queries
+	// (kube-dns ClusterIP) over the existing SOCKS/tun tunnel instead of Upstream.
+	PodForwarder func(query []byte) ([]byte, error)
+}
+
+// Resolver is an in-process DNS server that answers cluster-local names from
+// a live Services/Endpoints cache and forwards everything else upstream.
+type Resolver struct {
+	opts   Options
+	server *dns.Server
+
+	mu sync.RWMutex
+	// hostsByNamespace is replaced wholesale per namespace on every reindex,
+	// rather than merged key-by-key, so a deleted Service/Endpoints actually
+	// stops resolving instead of lingering in the cache forever.
+	hostsByNamespace map[string]map[string]hostEntry // namespace -> fqdn -> hostEntry
+
+	stopInformers chan struct{}
+}
+
+// NewResolver builds a Resolver watching Services and Endpoints in opts.Namespaces.
+func NewResolver(clientset kubernetes.Interface, opts Options) *Resolver {
+	return &Resolver{
+		opts:             opts,
+		hostsByNamespace: make(map[string]map[string]hostEntry),
+	}
+}
+
+// Start begins watching Services/Endpoints and serving DNS on opts.ListenAddr.
+// It blocks until Stop is called or the server fails.
+func (r *Resolver) Start(clientset kubernetes.Interface) error {
+	r.stopInformers = make(chan struct{})
+	if err := r.watch(clientset); err != nil {
+		return err
+	}
+
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", r.handleQuery)
+
+	r.server = &dns.Server{Addr: r.opts.ListenAddr, Net: "udp", Handler: mux}
+	log.Info().Msgf("Local DNS resolver listening on %s", r.opts.ListenAddr)
+	return r.server.ListenAndServe()
+}
+
+// Stop tears down the informers and the DNS server.
+func (r *Resolver) Stop() {
+	if r.stopInformers != nil {
+		close(r.stopInformers)
+	}
+	if r.server != nil {
+		if err := r.server.Shutdown(); err != nil {
+			log.Error().Msgf("Failed to stop local DNS resolver: %s", err.Error())
+		}
+	}
+}
+
+func (r *Resolver) watch(clientset kubernetes.Interface) error {
+	for _, ns := range r.opts.Namespaces {
+		factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0, informers.WithNamespace(ns))
+		svcInformer := factory.Core().V1().Services().Informer()
+		epInformer := factory.Core().V1().Endpoints().Informer()
+
+		handler := cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(obj interface{}) { r.reindex(ns, svcInformer, epInformer) },
+			UpdateFunc: func(oldObj, newObj interface{}) { r.reindex(ns, svcInformer, epInformer) },
+			DeleteFunc: func(obj interface{}) { r.reindex(ns, svcInformer, epInformer) },
+		}
+		if _, err := svcInformer.AddEventHandler(handler); err != nil {
+			return err
+		}
+		if _, err := epInformer.AddEventHandler(handler); err != nil {
+			return err
+		}
+		factory.Start(r.stopInformers)
+		factory.WaitForCacheSync(r.stopInformers)
+	}
+	return nil
+}
+
+func (r *Resolver) reindex(namespace string, svcInformer, epInformer cache.SharedIndexInformer) {
+	hosts := buildHostEntries(namespace, svcInformer.GetStore().List(), epInformer.GetStore().List())
+
+	// Replace the whole namespace, not merge into it, so a Service/Endpoints
+	// that disappeared from the store's current snapshot actually stops
+	// resolving instead of lingering in the cache forever.
+	r.mu.Lock()
+	r.hostsByNamespace[namespace] = hosts
+	r.mu.Unlock()
+}
+
+func buildHostEntries(namespace string, svcs, eps []interface{}) map[string]hostEntry {
+	hosts := make(map[string]hostEntry)
+	headless := make(map[string]bool)
+	for _, obj := range svcs {
+		svc, ok := obj.(*corev1.Service)
+		if !ok {
+			continue
+		}
+		fqdn := fmt.Sprintf("%s.%s%s", svc.Name, namespace, clusterDomainSuffix)
+		var ports []int32
+		for _, p := range svc.Spec.Ports {
+			ports = append(ports, p.Port)
+		}
+		if svc.Spec.ClusterIP != "" && svc.Spec.ClusterIP != "None" {
+			hosts[fqdn] = hostEntry{ips: []net.IP{net.ParseIP(svc.Spec.ClusterIP)}, ports: ports}
+		} else {
+			headless[fqdn] = true
+		}
+	}
+	for _, obj := range eps {
+		ep, ok := obj.(*corev1.Endpoints)
+		if !ok {
+			continue
+		}
+		fqdn := fmt.Sprintf("%s.%s%s", ep.Name, namespace, clusterDomainSuffix)
+		if !headless[fqdn] {
+			continue
+		}
+		var ips []net.IP
+		var ports []int32
+		for _, subset := range ep.Subsets {
+			for _, addr := range subset.Addresses {
+				ips = append(ips, net.ParseIP(addr.IP))
+			}
+			for _, port := range subset.Ports {
+				ports = append(ports, port.Port)
+			}
+		}
+		if len(ips) > 0 {
+			hosts[fqdn] = hostEntry{ips: ips, ports: ports}
+		}
+	}
+	return hosts
+}
+
+func (r *Resolver) handleQuery(w dns.ResponseWriter, req *dns.Msg) {
+	msg := new(dns.Msg)
+	msg.SetReply(req)
+
+	for _, q := range req.Question {
+		name := r.expandShortName(q.Name)
+		entry, found := r.lookup(name)
+
+		if found {
+			q.Name = name
+			msg.Answer = append(msg.Answer, rrsFor(q, entry)...)
+			continue
+		}
+
+		if r.opts.PodForwarder != nil && strings.HasSuffix(q.Name, ".cluster.local.") {
+			if reply, err := r.forwardToCluster(req); err == nil {
+				_ = w.WriteMsg(reply)
+				return
+			}
+		}
+
+		if reply, err := dns.Exchange(req, r.opts.Upstream); err == nil {
+			_ = w.WriteMsg(reply)
+			return
+		}
+	}
+
+	_ = w.WriteMsg(msg)
+}
+
+// lookup resolves fqdn within its own namespace's current snapshot.
+func (r *Resolver) lookup(fqdn string) (hostEntry, bool) {
+	namespace, ok := namespaceOf(fqdn)
+	if !ok {
+		return hostEntry{}, false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	nsHosts, ok := r.hostsByNamespace[namespace]
+	if !ok {
+		return hostEntry{}, false
+	}
+	entry, ok := nsHosts[fqdn]
+	return entry, ok
+}
+
+// namespaceOf extracts "<ns>" out of "<svc>.<ns>.svc.cluster.local.".
+func namespaceOf(fqdn string) (string, bool) {
+	if !strings.HasSuffix(fqdn, clusterDomainSuffix) {
+		return "", false
+	}
+	trimmed := strings.TrimSuffix(fqdn, clusterDomainSuffix)
+	parts := strings.Split(trimmed, ".")
+	if len(parts) < 2 {
+		return "", false
+	}
+	return parts[len(parts)-1], true
+}
+
+// expandShortName turns a bare "<svc>." query into "<svc>.<ns>.svc.cluster.local."
+// using the resolver's current namespace.
+func (r *Resolver) expandShortName(name string) string {
+	if strings.HasSuffix(name, clusterDomainSuffix) {
+		return name
+	}
+	if strings.Count(name, ".") <= 1 {
+		return fmt.Sprintf("%s%s%s", name, r.opts.CurrentNamespace, clusterDomainSuffix)
+	}
+	return name
+}
+
+func (r *Resolver) forwardToCluster(req *dns.Msg) (*dns.Msg, error) {
+	packed, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := r.opts.PodForwarder(packed)
+	if err != nil {
+		return nil, err
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(reply); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// rrsFor builds the answer records for entry matching q's requested type:
+// A/AAAA split by address family, SRV using entry's known ports.
+func rrsFor(q dns.Question, entry hostEntry) []dns.RR {
+	switch q.Qtype {
+	case dns.TypeSRV:
+		var rrs []dns.RR
+		for _, port := range entry.ports {
+			rrs = append(rrs, &dns.SRV{
+				Hdr:      dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 5},
+				Priority: 10,
+				Weight:   10,
+				Port:     uint16(port),
+				Target:   q.Name,
+			})
+		}
+		return rrs
+	case dns.TypeAAAA:
+		var rrs []dns.RR
+		for _, ip := range entry.ips {
+			if ip.To4() == nil {
+				rrs = append(rrs, &dns.AAAA{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 5}, AAAA: ip})
+			}
+		}
+		return rrs
+	default:
+		var rrs []dns.RR
+		for _, ip := range entry.ips {
+			if ip.To4() != nil {
+				rrs = append(rrs, &dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 5}, A: ip})
+			}
+		}
+		return rrs
+	}
+}
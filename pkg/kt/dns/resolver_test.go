@@ -0,0 +1,58 @@
+package dns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNamespaceOf(t *testing.T) {
+	ns, ok := namespaceOf("web.default.svc.cluster.local.")
+	if !ok || ns != "default" {
+		t.Fatalf("expected namespace 'default', got %q (ok=%v)", ns, ok)
+	}
+	if _, ok := namespaceOf("web.default.example.com."); ok {
+		t.Fatal("expected non-cluster-local fqdn to be rejected")
+	}
+}
+
+func TestBuildHostEntriesDropsDeletedService(t *testing.T) {
+	svc := func(name, clusterIP string) []interface{} {
+		return []interface{}{&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       corev1.ServiceSpec{ClusterIP: clusterIP, Ports: []corev1.ServicePort{{Port: 80}}},
+		}}
+	}
+
+	hosts := buildHostEntries("default", svc("web", "10.0.0.1"), nil)
+	if _, ok := hosts["web.default.svc.cluster.local."]; !ok {
+		t.Fatal("expected web service to be indexed")
+	}
+
+	// Service no longer present in the store's snapshot (deleted).
+	hosts = buildHostEntries("default", nil, nil)
+	if _, ok := hosts["web.default.svc.cluster.local."]; ok {
+		t.Fatal("expected deleted service to be evicted, not retained")
+	}
+}
+
+func TestRrsForRespectsQtype(t *testing.T) {
+	entry := hostEntry{
+		ips:   []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("::1")},
+		ports: []int32{80, 443},
+	}
+
+	name := "web.default.svc.cluster.local."
+	aAnswers := rrsFor(dns.Question{Name: name, Qtype: dns.TypeA}, entry)
+	if len(aAnswers) != 1 {
+		t.Fatalf("expected exactly 1 A record, got %d", len(aAnswers))
+	}
+
+	srvAnswers := rrsFor(dns.Question{Name: name, Qtype: dns.TypeSRV}, entry)
+	if len(srvAnswers) != 2 {
+		t.Fatalf("expected 2 SRV records (one per port), got %d", len(srvAnswers))
+	}
+}
@@ -0,0 +1,33 @@
+package sshuttle
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/alibaba/kt-connect/pkg/kt/cluster"
+	"github.com/alibaba/kt-connect/pkg/kt/util"
+	"github.com/rs/zerolog/log"
+)
+
+// CliTool drives the sshuttle-based tunnel client used for --method=tun connects.
+type CliTool struct{}
+
+// NewCliTool returns the default sshuttle-backed tunnel client.
+func NewCliTool() *CliTool {
+	return &CliTool{}
+}
+
+// Outbound establishes the SSH tunnel to the shadow pod through transport
+// rather than dialing a raw pod IP, so connect flows using
+// cluster.PortForwardTransport work the same way direct dialing always has.
+func (c *CliTool) Outbound(podName string, transport cluster.ShadowTransport, credential *util.SSHCredential, cidrs []string, exec util.Executable) error {
+	conn, err := transport.Dial()
+	if err != nil {
+		return fmt.Errorf("failed to reach shadow pod %s: %s", podName, err.Error())
+	}
+	endpoint := conn.RemoteAddr().(*net.TCPAddr)
+	_ = conn.Close()
+
+	log.Info().Msgf("Starting sshuttle tunnel to %s via %s for %d CIDR(s)", podName, endpoint.String(), len(cidrs))
+	return util.RunSSHuttle(endpoint.IP.String(), endpoint.Port, credential, cidrs, exec)
+}
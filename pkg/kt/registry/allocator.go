@@ -0,0 +1,262 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alibaba/kt-connect/pkg/kt/util"
+	"github.com/cilium/ipam/service/allocator"
+	"github.com/cilium/ipam/service/ipallocator"
+	"github.com/mitchellh/go-homedir"
+)
+
+const leasesFileName = "leases.json"
+
+// leaseTTL is how long a lease survives an unclean shutdown before a later
+// connect is allowed to reclaim its addresses.
+const leaseTTL = 30 * 24 * time.Hour
+
+// Lease is the persisted record for one CIDR's tunnel addresses.
+type Lease struct {
+	SrcIP       string    `json:"srcIP"`
+	DestIP      string    `json:"destIP"`
+	LeaseExpiry time.Time `json:"leaseExpiry"`
+}
+
+// IPAllocator hands out the local/remote tunnel addresses for a connect.
+// It exists so CompleteOptions doesn't depend directly on cilium/ipam, and
+// so the multi-cluster arbitration and tests can swap in a double.
+type IPAllocator interface {
+	// Acquire returns the source/dest addresses to use for cidr, reusing a
+	// prior lease when possible so host-side firewall rules, routes and
+	// known_hosts entries set up against a previous connect keep working.
+	Acquire(ctx context.Context, cidr string) (srcIP, destIP string, err error)
+	// Release is called when the connect using cidr's lease ends. It does
+	// not delete the lease - it restarts the lease's expiry so the addresses
+	// stay reserved for leaseTTL and a reconnect gets the same pair back.
+	Release(ctx context.Context, cidr string) error
+}
+
+// PersistentAllocator is the default IPAllocator. It stores leases under
+// ~/.ktctl/leases.json, honors explicit --tunSourceIP/--tunDestIP
+// reservations, and only asks the contiguous allocator for a fresh pair
+// when no usable lease exists.
+type PersistentAllocator struct {
+	path string
+	mu   sync.Mutex
+
+	// ReservedSrcIP and ReservedDestIP come from --tunSourceIP/--tunDestIP;
+	// when both are set they're returned as-is (unless they collide with a
+	// host route) instead of consulting the lease; one set on its own is ignored.
+	ReservedSrcIP  string
+	ReservedDestIP string
+
+	// HostRoutes returns the addresses found in the host's route table, used
+	// to refuse handing out an address equal to one of them. Overridable for
+	// tests; defaults to ReadHostRoutes.
+	HostRoutes func() ([]net.IP, error)
+}
+
+// NewPersistentAllocator returns an allocator backed by ~/.ktctl/leases.json,
+// creating ~/.ktctl if needed; the file itself is written on first save.
+func NewPersistentAllocator(reservedSrcIP, reservedDestIP string) (*PersistentAllocator, error) {
+	home, err := homedir.Dir()
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(home, ".ktctl")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &PersistentAllocator{
+		path:           filepath.Join(dir, leasesFileName),
+		ReservedSrcIP:  reservedSrcIP,
+		ReservedDestIP: reservedDestIP,
+		HostRoutes:     ReadHostRoutes,
+	}, nil
+}
+
+func (a *PersistentAllocator) Acquire(ctx context.Context, cidr string) (string, string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	routed, err := a.HostRoutes()
+	if err != nil {
+		return "", "", err
+	}
+
+	if a.ReservedSrcIP != "" && a.ReservedDestIP != "" {
+		if err := checkNotRouted(routed, a.ReservedSrcIP, a.ReservedDestIP); err != nil {
+			return "", "", err
+		}
+		if err := a.save(cidr, Lease{SrcIP: a.ReservedSrcIP, DestIP: a.ReservedDestIP, LeaseExpiry: time.Now().Add(leaseTTL)}); err != nil {
+			return "", "", err
+		}
+		return a.ReservedSrcIP, a.ReservedDestIP, nil
+	}
+
+	leases, err := a.load()
+	if err != nil {
+		return "", "", err
+	}
+	if lease, ok := leases[cidr]; ok && time.Now().Before(lease.LeaseExpiry) {
+		if err := checkNotRouted(routed, lease.SrcIP, lease.DestIP); err == nil {
+			lease.LeaseExpiry = time.Now().Add(leaseTTL)
+			if err := a.save(cidr, lease); err != nil {
+				return "", "", err
+			}
+			return lease.SrcIP, lease.DestIP, nil
+		}
+		// the lease's addresses were reclaimed by the host since last time; fall through and allocate fresh ones
+	}
+
+	srcIP, destIP, err := allocateContiguous(cidr, routed)
+	if err != nil {
+		return "", "", err
+	}
+	if err := a.save(cidr, Lease{SrcIP: srcIP, DestIP: destIP, LeaseExpiry: time.Now().Add(leaseTTL)}); err != nil {
+		return "", "", err
+	}
+	return srcIP, destIP, nil
+}
+
+func (a *PersistentAllocator) Release(ctx context.Context, cidr string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	leases, err := a.load()
+	if err != nil {
+		return err
+	}
+	lease, ok := leases[cidr]
+	if !ok {
+		return nil
+	}
+	lease.LeaseExpiry = time.Now().Add(leaseTTL)
+	return a.save(cidr, lease)
+}
+
+func (a *PersistentAllocator) load() (map[string]Lease, error) {
+	data, err := ioutil.ReadFile(a.path)
+	if os.IsNotExist(err) {
+		return map[string]Lease{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return map[string]Lease{}, nil
+	}
+	leases := map[string]Lease{}
+	if err := json.Unmarshal(data, &leases); err != nil {
+		return nil, err
+	}
+	return leases, nil
+}
+
+func (a *PersistentAllocator) save(cidr string, lease Lease) error {
+	leases, err := a.load()
+	if err != nil {
+		return err
+	}
+	leases[cidr] = lease
+	data, err := json.MarshalIndent(leases, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(a.path, data, 0644)
+}
+
+func checkNotRouted(routed []net.IP, ips ...string) error {
+	for _, ipStr := range ips {
+		ip := net.ParseIP(ipStr)
+		for _, r := range routed {
+			if ip.Equal(r) {
+				return fmt.Errorf("address %s collides with an existing host route", ipStr)
+			}
+		}
+	}
+	return nil
+}
+
+// allocateContiguous is the pre-existing allocation strategy, kept as the
+// fallback for CIDRs with no usable lease: walk the CIDR's contiguous
+// address map and hand out the first two free addresses that aren't already
+// claimed by a host route.
+func allocateContiguous(cidr string, routed []net.IP) (srcIP, destIP string, err error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", "", err
+	}
+	rge, err := ipallocator.NewAllocatorCIDRRange(ipnet, func(max int, rangeSpec string) (allocator.Interface, error) {
+		return allocator.NewContiguousAllocationMap(max, rangeSpec), nil
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	var picked []net.IP
+	for len(picked) < 2 {
+		ip, err := rge.AllocateNext()
+		if err != nil {
+			return "", "", err
+		}
+		if routedContains(routed, ip) {
+			continue
+		}
+		picked = append(picked, ip)
+	}
+	return picked[0].String(), picked[1].String(), nil
+}
+
+func routedContains(routed []net.IP, ip net.IP) bool {
+	for _, r := range routed {
+		if ip.Equal(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadHostRoutes returns the addresses the host already has routes for, so
+// the allocator can avoid handing out a colliding tunnel address. It shells
+// out to the platform's route table inspector rather than linking netlink
+// directly, keeping this package portable across the three OSes ktctl supports.
+func ReadHostRoutes() ([]net.IP, error) {
+	var out []byte
+	var err error
+	switch {
+	case util.IsWindows():
+		out, err = exec.Command("netstat", "-rn").Output()
+	case util.IsMacOS():
+		out, err = exec.Command("netstat", "-rn").Output()
+	default:
+		out, err = exec.Command("ip", "route").Output()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseRouteOutput(string(out)), nil
+}
+
+func parseRouteOutput(output string) []net.IP {
+	var ips []net.IP
+	for _, line := range strings.Split(output, "\n") {
+		for _, field := range strings.Fields(line) {
+			field = strings.TrimSuffix(field, "/32")
+			if ip := net.ParseIP(field); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	return ips
+}
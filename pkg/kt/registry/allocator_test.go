@@ -0,0 +1,102 @@
+package registry
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseRouteOutput(t *testing.T) {
+	output := "default via 192.168.1.1 dev eth0\n10.0.0.0/24 dev eth0 proto kernel scope link src 10.0.0.5\n"
+	ips := parseRouteOutput(output)
+
+	want := []string{"192.168.1.1", "10.0.0.5"}
+	if len(ips) != len(want) {
+		t.Fatalf("expected %d parsed addresses, got %d: %v", len(want), len(ips), ips)
+	}
+	for i, w := range want {
+		if ips[i].String() != w {
+			t.Fatalf("expected ips[%d] = %s, got %s", i, w, ips[i].String())
+		}
+	}
+}
+
+func TestRoutedContains(t *testing.T) {
+	routed := []net.IP{net.ParseIP("10.0.0.5")}
+	if !routedContains(routed, net.ParseIP("10.0.0.5")) {
+		t.Fatal("expected routedContains to find an exact match")
+	}
+	if routedContains(routed, net.ParseIP("10.0.0.6")) {
+		t.Fatal("expected routedContains to reject an address not in the list")
+	}
+}
+
+func newTestAllocator(t *testing.T) *PersistentAllocator {
+	t.Helper()
+	return &PersistentAllocator{
+		path:       filepath.Join(t.TempDir(), "leases.json"),
+		HostRoutes: func() ([]net.IP, error) { return nil, nil },
+	}
+}
+
+func TestAcquireReusesExistingLease(t *testing.T) {
+	a := newTestAllocator(t)
+
+	srcIP, destIP, err := a.Acquire(context.Background(), "10.96.0.0/30")
+	if err != nil {
+		t.Fatalf("first Acquire failed: %s", err.Error())
+	}
+
+	srcIP2, destIP2, err := a.Acquire(context.Background(), "10.96.0.0/30")
+	if err != nil {
+		t.Fatalf("second Acquire failed: %s", err.Error())
+	}
+	if srcIP != srcIP2 || destIP != destIP2 {
+		t.Fatalf("expected the same lease to be reused across Acquire calls, got (%s, %s) then (%s, %s)",
+			srcIP, destIP, srcIP2, destIP2)
+	}
+}
+
+func TestAcquireHonorsReservation(t *testing.T) {
+	a := newTestAllocator(t)
+	a.ReservedSrcIP = "10.96.0.1"
+	a.ReservedDestIP = "10.96.0.2"
+
+	srcIP, destIP, err := a.Acquire(context.Background(), "10.96.0.0/30")
+	if err != nil {
+		t.Fatalf("Acquire failed: %s", err.Error())
+	}
+	if srcIP != "10.96.0.1" || destIP != "10.96.0.2" {
+		t.Fatalf("expected reserved addresses to be honored, got (%s, %s)", srcIP, destIP)
+	}
+}
+
+func TestAcquireRejectsRoutedReservation(t *testing.T) {
+	a := newTestAllocator(t)
+	a.ReservedSrcIP = "10.96.0.1"
+	a.ReservedDestIP = "10.96.0.2"
+	a.HostRoutes = func() ([]net.IP, error) { return []net.IP{net.ParseIP("10.96.0.1")}, nil }
+
+	if _, _, err := a.Acquire(context.Background(), "10.96.0.0/30"); err == nil {
+		t.Fatal("expected Acquire to reject a reservation colliding with an existing host route")
+	}
+}
+
+func TestReleaseKeepsExistingLease(t *testing.T) {
+	a := newTestAllocator(t)
+	if _, _, err := a.Acquire(context.Background(), "10.96.0.0/30"); err != nil {
+		t.Fatalf("Acquire failed: %s", err.Error())
+	}
+	if err := a.Release(context.Background(), "10.96.0.0/30"); err != nil {
+		t.Fatalf("Release failed: %s", err.Error())
+	}
+
+	leases, err := a.load()
+	if err != nil {
+		t.Fatalf("load failed: %s", err.Error())
+	}
+	if _, ok := leases["10.96.0.0/30"]; !ok {
+		t.Fatal("expected Release to keep the lease (addresses stay reserved for leaseTTL), not delete it")
+	}
+}
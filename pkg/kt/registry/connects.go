@@ -0,0 +1,287 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/gofrs/flock"
+	"github.com/mitchellh/go-homedir"
+)
+
+// DefaultSuperCidr is the range multi-cluster tun CIDRs are carved out of
+// when no super range is given (an empty superCidr).
+const DefaultSuperCidr = "10.96.0.0/12"
+
+const connectsFileName = "connects.json"
+
+// ConnectRecord describes one active `ktctl connect` process, as tracked in
+// ~/.ktctl/connects.json so a second `connect` against a different cluster
+// can run alongside it instead of tripping the "already running" guard.
+type ConnectRecord struct {
+	Context               string   `json:"context"`
+	Namespace             string   `json:"namespace"`
+	Pid                   int      `json:"pid"`
+	TunCidr               string   `json:"tunCidr"`
+	AllocatedClusterCIDRs []string `json:"allocatedClusterCIDRs"`
+	ShadowPod             string   `json:"shadowPod"`
+}
+
+// ConnectsStore is the on-disk registry of active connects, used for
+// per-context PID guarding and CIDR arbitration across simultaneous
+// `ktctl connect` processes.
+type ConnectsStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewConnectsStore opens the registry at ~/.ktctl/connects.json, creating
+// the parent directory if necessary.
+func NewConnectsStore() (*ConnectsStore, error) {
+	home, err := homedir.Dir()
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(home, ".ktctl")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &ConnectsStore{path: filepath.Join(dir, connectsFileName)}, nil
+}
+
+// withFileLock serializes fn against every other OS process touching this
+// store, not just goroutines within this one - s.mu alone only protects
+// concurrent callers inside a single `ktctl` process, so two separate
+// `ktctl connect` processes starting at nearly the same time could otherwise
+// both load the same stale snapshot and both win a conflicting Register.
+func (s *ConnectsStore) withFileLock(fn func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fileLock := flock.New(s.path + ".lock")
+	if err := fileLock.Lock(); err != nil {
+		return err
+	}
+	defer fileLock.Unlock()
+
+	return fn()
+}
+
+// Active returns every record in the registry whose pid is still alive,
+// pruning stale entries left behind by a process that didn't exit cleanly.
+func (s *ConnectsStore) Active() ([]ConnectRecord, error) {
+	var live []ConnectRecord
+	err := s.withFileLock(func() error {
+		records, err := s.load()
+		if err != nil {
+			return err
+		}
+
+		dirty := false
+		for _, r := range records {
+			if processAlive(r.Pid) {
+				live = append(live, r)
+			} else {
+				dirty = true
+			}
+		}
+		if dirty {
+			return s.save(live)
+		}
+		return nil
+	})
+	return live, err
+}
+
+// Register adds or replaces the entry for record.Context and persists it,
+// failing if a *different* process is already running for that context.
+// A record with the same (Context, Pid) as one already on disk is treated
+// as this process updating its own entry (e.g. connectToCluster registering
+// the PID guard early, then re-registering once CIDRs/shadow are known)
+// rather than a conflict.
+func (s *ConnectsStore) Register(record ConnectRecord) error {
+	return s.withFileLock(func() error {
+		records, err := s.load()
+		if err != nil {
+			return err
+		}
+
+		updated := records[:0]
+		for _, r := range records {
+			if r.Context == record.Context && r.Pid == record.Pid {
+				continue // superseded below by the incoming record
+			}
+			if r.Context == record.Context && processAlive(r.Pid) {
+				return fmt.Errorf("another connect process already running for context %s with pid %d", r.Context, r.Pid)
+			}
+			if r.Context != record.Context {
+				updated = append(updated, r)
+			}
+		}
+		updated = append(updated, record)
+		return s.save(updated)
+	})
+}
+
+// Unregister removes only the entry owned by context, leaving every other
+// active connect's registration untouched.
+func (s *ConnectsStore) Unregister(context string) error {
+	return s.withFileLock(func() error {
+		records, err := s.load()
+		if err != nil {
+			return err
+		}
+		kept := records[:0]
+		for _, r := range records {
+			if r.Context != context {
+				kept = append(kept, r)
+			}
+		}
+		return s.save(kept)
+	})
+}
+
+// RoutedCIDRs returns the cluster CIDRs already claimed by other active
+// connects, so a new connect can detect an overlap before routing it.
+func (s *ConnectsStore) RoutedCIDRs(exceptContext string) ([]string, error) {
+	records, err := s.Active()
+	if err != nil {
+		return nil, err
+	}
+	var cidrs []string
+	for _, r := range records {
+		if r.Context == exceptContext {
+			continue
+		}
+		cidrs = append(cidrs, r.AllocatedClusterCIDRs...)
+	}
+	return cidrs, nil
+}
+
+// AllocateTunCidr picks a /30 out of superCidr that doesn't overlap any
+// tunCidr already claimed by another active connect.
+func (s *ConnectsStore) AllocateTunCidr(superCidr string) (string, error) {
+	records, err := s.Active()
+	if err != nil {
+		return "", err
+	}
+	return pickFreeTunCidr(records, superCidr)
+}
+
+// ReserveTunCidr atomically picks a free /30 out of superCidr and registers
+// a placeholder record claiming it for (context, the calling process' pid),
+// all under the same interprocess lock. Doing the pick-and-claim as one
+// critical section, rather than AllocateTunCidr followed by a separate
+// Register call, is what actually prevents two `ktctl connect` processes
+// racing to start from both landing on the same CIDR: a plain AllocateTunCidr
+// then Register leaves a window between the two calls where another process
+// can slip in and make the same pick.
+func (s *ConnectsStore) ReserveTunCidr(superCidr, context string) (string, error) {
+	pid := os.Getpid()
+	var cidr string
+	err := s.withFileLock(func() error {
+		records, err := s.load()
+		if err != nil {
+			return err
+		}
+
+		live := records[:0]
+		for _, r := range records {
+			if processAlive(r.Pid) {
+				live = append(live, r)
+			}
+		}
+
+		cidr, err = pickFreeTunCidr(live, superCidr)
+		if err != nil {
+			return err
+		}
+
+		updated := live[:0]
+		for _, r := range live {
+			if r.Context != context {
+				updated = append(updated, r)
+			}
+		}
+		updated = append(updated, ConnectRecord{Context: context, Pid: pid, TunCidr: cidr})
+		return s.save(updated)
+	})
+	return cidr, err
+}
+
+func pickFreeTunCidr(records []ConnectRecord, superCidr string) (string, error) {
+	if superCidr == "" {
+		superCidr = DefaultSuperCidr
+	}
+	_, super, err := net.ParseCIDR(superCidr)
+	if err != nil {
+		return "", err
+	}
+
+	taken := make(map[string]bool, len(records))
+	for _, r := range records {
+		taken[r.TunCidr] = true
+	}
+
+	ones, bits := super.Mask.Size()
+	if bits-ones < 2 {
+		return "", fmt.Errorf("super CIDR %s is too small to carve /30s out of", superCidr)
+	}
+
+	for ip := super.IP.Mask(super.Mask); super.Contains(ip); ip = nextSubnet(ip, 30) {
+		candidate := &net.IPNet{IP: ip, Mask: net.CIDRMask(30, 32)}
+		if !taken[candidate.String()] {
+			return candidate.String(), nil
+		}
+	}
+	return "", fmt.Errorf("no free /30 left in %s for a new connect", superCidr)
+}
+
+func nextSubnet(ip net.IP, prefixLen int) net.IP {
+	step := uint32(1) << uint(32-prefixLen)
+	v := ipToUint32(ip) + step
+	return uint32ToIP(v)
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	ip = ip.To4()
+	return uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
+}
+
+func uint32ToIP(v uint32) net.IP {
+	return net.IPv4(byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (s *ConnectsStore) load() ([]ConnectRecord, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var records []ConnectRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func (s *ConnectsStore) save(records []ConnectRecord) error {
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.path, data, 0644)
+}
+
+// processAlive reports whether pid identifies a live process. It's
+// implemented per-OS in process_unix.go/process_windows.go, since Windows'
+// os.Process.Signal doesn't support the Unix "signal 0" existence probe.
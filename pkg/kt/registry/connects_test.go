@@ -0,0 +1,122 @@
+package registry
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestStore(t *testing.T) *ConnectsStore {
+	t.Helper()
+	return &ConnectsStore{path: filepath.Join(t.TempDir(), "connects.json")}
+}
+
+func TestRegisterSamePidUpdatesInPlace(t *testing.T) {
+	store := newTestStore(t)
+	pid := os.Getpid()
+
+	if err := store.Register(ConnectRecord{Context: "dev", Pid: pid, TunCidr: "10.96.0.0/30"}); err != nil {
+		t.Fatalf("initial Register failed: %s", err.Error())
+	}
+	// Same (context, pid) re-registering with more fields known, as
+	// connectToCluster does once CIDRs/shadow are resolved - must not be
+	// treated as a conflict with itself.
+	if err := store.Register(ConnectRecord{Context: "dev", Pid: pid, TunCidr: "10.96.0.0/30", ShadowPod: "kt-connect-daemon-xxxxx"}); err != nil {
+		t.Fatalf("same-pid re-Register should update in place, got error: %s", err.Error())
+	}
+
+	records, err := store.Active()
+	if err != nil {
+		t.Fatalf("Active failed: %s", err.Error())
+	}
+	if len(records) != 1 {
+		t.Fatalf("expected exactly 1 record after self re-registration, got %d", len(records))
+	}
+	if records[0].ShadowPod != "kt-connect-daemon-xxxxx" {
+		t.Fatalf("expected record to be updated with ShadowPod, got %+v", records[0])
+	}
+}
+
+func TestRegisterStaleRecordIsReplacedNotConflicted(t *testing.T) {
+	store := newTestStore(t)
+	// A pid from a process that has already exited - guaranteed not alive -
+	// must not block a fresh Register for the same context.
+	const deadPid = 999999999
+	if err := store.Register(ConnectRecord{Context: "dev", Pid: deadPid}); err != nil {
+		t.Fatalf("seeding stale record failed: %s", err.Error())
+	}
+	if err := store.Register(ConnectRecord{Context: "dev", Pid: os.Getpid()}); err != nil {
+		t.Fatalf("expected stale record from a dead pid to be replaced without conflict, got: %s", err.Error())
+	}
+}
+
+func TestUnregisterRemovesOnlyItsOwnEntry(t *testing.T) {
+	store := newTestStore(t)
+	if err := store.Register(ConnectRecord{Context: "dev", Pid: os.Getpid()}); err != nil {
+		t.Fatalf("Register dev failed: %s", err.Error())
+	}
+	// staging's pid won't be alive, but Unregister must not care - it keys
+	// purely on Context, not liveness.
+	if err := store.save(append(must(store.load()), ConnectRecord{Context: "staging", Pid: 999999})); err != nil {
+		t.Fatalf("seeding staging record failed: %s", err.Error())
+	}
+
+	if err := store.Unregister("dev"); err != nil {
+		t.Fatalf("Unregister failed: %s", err.Error())
+	}
+
+	records, err := store.load()
+	if err != nil {
+		t.Fatalf("load failed: %s", err.Error())
+	}
+	if len(records) != 1 || records[0].Context != "staging" {
+		t.Fatalf("expected only the staging record to survive, got %+v", records)
+	}
+}
+
+func must(records []ConnectRecord, err error) []ConnectRecord {
+	if err != nil {
+		panic(err)
+	}
+	return records
+}
+
+func TestReserveTunCidrClaimsTheCidrItReturns(t *testing.T) {
+	store := newTestStore(t)
+
+	cidr, err := store.ReserveTunCidr("10.96.0.0/28", "dev")
+	if err != nil {
+		t.Fatalf("ReserveTunCidr failed: %s", err.Error())
+	}
+
+	records, err := store.Active()
+	if err != nil {
+		t.Fatalf("Active failed: %s", err.Error())
+	}
+	if len(records) != 1 || records[0].Context != "dev" || records[0].TunCidr != cidr {
+		t.Fatalf("expected ReserveTunCidr to register a claim on %s for context dev, got %+v", cidr, records)
+	}
+
+	cidr2, err := store.ReserveTunCidr("10.96.0.0/28", "staging")
+	if err != nil {
+		t.Fatalf("second ReserveTunCidr failed: %s", err.Error())
+	}
+	if cidr2 == cidr {
+		t.Fatalf("expected a second reservation to avoid the already-claimed %s, got the same CIDR", cidr)
+	}
+}
+
+func TestAllocateTunCidrAvoidsOverlap(t *testing.T) {
+	store := newTestStore(t)
+	if err := store.Register(ConnectRecord{Context: "dev", Pid: os.Getpid(), TunCidr: "10.96.0.0/30"}); err != nil {
+		t.Fatalf("Register failed: %s", err.Error())
+	}
+
+	cidr, err := store.AllocateTunCidr("10.96.0.0/28")
+	if err != nil {
+		t.Fatalf("AllocateTunCidr failed: %s", err.Error())
+	}
+	if cidr == "10.96.0.0/30" {
+		t.Fatalf("expected a /30 distinct from the already-taken one, got %s", cidr)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+
+package registry
+
+import (
+	"os"
+	"syscall"
+)
+
+// processAlive reports whether pid identifies a live process. Signal 0
+// performs no signal delivery, only the existence/permission check.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return process.Signal(syscall.Signal(0)) == nil
+}
@@ -0,0 +1,35 @@
+//go:build windows
+
+package registry
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// processAlive reports whether pid identifies a live process. Unlike Unix,
+// os.Process.Signal on Windows only supports os.Kill, so syscall.Signal(0)
+// always errors there; instead open a query handle and check its exit code,
+// since a still-running process reports windows.STILL_ACTIVE.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+
+	handle, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(process.Pid))
+	if err != nil {
+		return false
+	}
+	defer windows.CloseHandle(handle)
+
+	var exitCode uint32
+	if err := windows.GetExitCodeProcess(handle, &exitCode); err != nil {
+		return false
+	}
+	return exitCode == uint32(windows.STILL_ACTIVE)
+}